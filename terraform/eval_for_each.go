@@ -0,0 +1,317 @@
+package terraform
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/terraform/tfdiags"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// evaluateResourceForEachExpression is our standard mechanism for interpreting an
+// expression given for a "for_each" argument on a resource. This should
+// be called during expansion in order to determine the final keys and
+// values.
+//
+// evaluateResourceForEachExpression differs from evaluateForEachExpression
+// by returning additional diagnostics explaining that resource for_each
+// isn't allowed to be unknown.
+//
+// ordered should be set for resources that have for_each_ordered = true in
+// their configuration; it permits list and tuple values and causes the
+// returned order to reflect the input order rather than an arbitrary one.
+// The ordering itself is reported alongside the map rather than baked into
+// it, because map[string]cty.Value has no order of its own: callers that
+// build the resource's instance graph or render plan output are the ones
+// that need to consult order to preserve the user's input ordering.
+func evaluateResourceForEachExpression(expr hcl.Expression, ctx EvalContext, ordered bool) (forEach map[string]cty.Value, order []string, diags tfdiags.Diagnostics) {
+	forEach, order, known, diags := evaluateResourceForEachExpressionKnown(expr, ctx, ordered)
+	if !known {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid for_each argument",
+			Detail:   `The "for_each" value depends on resource attributes that cannot be determined until apply, so Terraform cannot predict how many instances will be created. To work around this, use the -target argument to first apply only the resources that the for_each depends on.`,
+			Subject:  expr.Range().Ptr(),
+		})
+	}
+	return forEach, order, diags
+}
+
+// evaluateResourceForEachExpressionKnown is like evaluateResourceForEachExpression
+// except that it handles an unknown result by returning an empty map and
+// known=false, so that a caller can distinguish "not yet known" from
+// "known to be empty".
+//
+// The validation here is delegated to a ForEachValidator using the same
+// strictness the plan-time evaluator has always used; the only knob it
+// sets is Ordered, which mirrors the ordered argument.
+func evaluateResourceForEachExpressionKnown(expr hcl.Expression, ctx EvalContext, ordered bool) (forEach map[string]cty.Value, order []string, known bool, diags tfdiags.Diagnostics) {
+	forEachVal, forEachDiags := ctx.EvaluateExpr(expr, cty.DynamicPseudoType, nil)
+	diags = diags.Append(forEachDiags)
+	if diags.HasErrors() {
+		return nil, nil, true, diags
+	}
+
+	if !forEachVal.IsNull() && !forEachVal.IsKnown() {
+		return map[string]cty.Value{}, nil, false, diags
+	}
+
+	// A set may contain unknown elements, which only IsWhollyKnown
+	// detects; map and object keys can never be unknown.
+	if forEachVal.Type().IsSetType() && !forEachVal.IsWhollyKnown() {
+		return map[string]cty.Value{}, nil, false, diags
+	}
+
+	validator := ForEachValidator{Ordered: ordered}
+	diags = diags.Append(validator.validate(forEachVal, expr.Range().Ptr()))
+	if diags.HasErrors() {
+		return map[string]cty.Value{}, nil, true, diags
+	}
+
+	forEach, order = forEachMapFromValue(forEachVal, ordered)
+	return forEach, order, true, diags
+}
+
+// ForEachValidator holds the validation rules for a for_each argument
+// value. The zero value matches the strictness the plan-time evaluator
+// has always applied: maps, objects, and sets of strings only, no nulls,
+// and no unknown lengths. Setting one of the boolean fields loosens the
+// corresponding rule for callers - such as the module for_each and
+// dynamic block evaluators, or third-party static analyzers doing partial
+// evaluation where many attributes are still unknown - that need to
+// accept values the plan-time evaluator must reject.
+type ForEachValidator struct {
+	// AllowUnknownLength permits a for_each value whose length can't yet
+	// be determined: an entirely unknown map or set, a set containing
+	// unknown elements, or (when Ordered is also set) a tuple containing a
+	// dynamically-typed element.
+	AllowUnknownLength bool
+
+	// AllowEmptyDynamicPseudoType permits a value of cty.DynamicPseudoType,
+	// known or unknown, to validate successfully as an empty collection
+	// instead of being rejected for its type or for being unknown. This is
+	// intended for partial evaluation, where an expression that can't yet
+	// be resolved at all reports back as cty.DynamicVal.
+	AllowEmptyDynamicPseudoType bool
+
+	// AllowNullElements permits null values inside a for_each set. Map and
+	// object attribute values are unaffected by this setting: they have
+	// always been allowed to be null.
+	AllowNullElements bool
+
+	// Ordered permits list and tuple values, keyed by the decimal string
+	// of each element's index, matching a resource's
+	// for_each_ordered = true opt-in.
+	Ordered bool
+}
+
+// Validate checks whether val is an acceptable for_each argument value
+// under the receiver's strictness settings. It doesn't evaluate an
+// expression or build the resulting instance map; callers that have both
+// should prefer ValidateExpr, which attaches a source range to any
+// diagnostics it returns.
+func (v ForEachValidator) Validate(val cty.Value) tfdiags.Diagnostics {
+	return v.validate(val, nil)
+}
+
+// ValidateExpr evaluates expr and validates the result under the
+// receiver's strictness settings, attaching expr's range to any
+// diagnostics it returns.
+func (v ForEachValidator) ValidateExpr(expr hcl.Expression, ctx EvalContext) tfdiags.Diagnostics {
+	val, diags := ctx.EvaluateExpr(expr, cty.DynamicPseudoType, nil)
+	if diags.HasErrors() {
+		return diags
+	}
+	return diags.Append(v.validate(val, expr.Range().Ptr()))
+}
+
+func (v ForEachValidator) validate(val cty.Value, subject *hcl.Range) tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
+
+	if val.Type() == cty.DynamicPseudoType && v.AllowEmptyDynamicPseudoType {
+		return diags
+	}
+
+	switch {
+	case val.IsNull():
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid for_each argument",
+			Detail:   `The given "for_each" argument value is unsuitable: the given "for_each" argument value is null. A map, set of strings, or object is allowed.`,
+			Subject:  subject,
+		})
+		return diags
+	case !val.IsKnown():
+		if v.AllowUnknownLength {
+			return diags
+		}
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid for_each argument",
+			Detail:   `The "for_each" value depends on resource attributes that cannot be determined until apply, so Terraform cannot predict how many instances will be created. To work around this, use the -target argument to first apply only the resources that the for_each depends on.`,
+			Subject:  subject,
+		})
+		return diags
+	}
+
+	ty := val.Type()
+	switch {
+	case ty.IsMapType(), ty.IsObjectType():
+		return diags.Append(v.validateAttrs(val, subject))
+	case ty.IsSetType():
+		return diags.Append(v.validateSet(val, subject))
+	case v.Ordered && (ty.IsListType() || ty.IsTupleType()):
+		return diags.Append(v.validateOrdered(val, subject))
+	case ty.IsListType(), ty.IsTupleType():
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid for_each argument",
+			Detail:   fmt.Sprintf(`The given "for_each" argument value is unsuitable: the "for_each" argument must be a map, or set of strings, and you have provided a value of type %s. To use a list or tuple, set for_each_ordered = true in the resource configuration.`, ty.FriendlyName()),
+			Subject:  subject,
+		})
+		return diags
+	default:
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid for_each argument",
+			Detail:   fmt.Sprintf(`The given "for_each" argument value is unsuitable: the "for_each" argument must be a map, or set of strings, and you have provided a value of type %s.`, ty.FriendlyName()),
+			Subject:  subject,
+		})
+		return diags
+	}
+}
+
+// validateAttrs handles the map and object cases, requiring that every
+// attribute name be a usable instance key. Unlike sets, map and object
+// values have always been allowed to be null here, since a null
+// each.value is meaningful on its own and doesn't stand in for "key
+// doesn't exist" the way a null set member would.
+func (v ForEachValidator) validateAttrs(val cty.Value, subject *hcl.Range) tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
+
+	for it := val.ElementIterator(); it.Next(); {
+		keyVal, _ := it.Element()
+		if keyVal.AsString() == "" {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid for_each argument",
+				Detail:   `The given "for_each" argument value is unsuitable: an empty string is not a valid instance key.`,
+				Subject:  subject,
+			})
+		}
+	}
+
+	return diags
+}
+
+// validateSet handles the set-of-strings case.
+func (v ForEachValidator) validateSet(val cty.Value, subject *hcl.Range) tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
+
+	if val.Type().ElementType() != cty.String {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid for_each set argument",
+			Detail:   fmt.Sprintf(`The given "for_each" argument value is unsuitable: "for_each" supports maps and sets of strings, but you have provided a set containing type %s.`, val.Type().ElementType().FriendlyName()),
+			Subject:  subject,
+		})
+		return diags
+	}
+
+	if !val.IsWhollyKnown() && !v.AllowUnknownLength {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid for_each argument",
+			Detail:   `The "for_each" value depends on resource attributes that cannot be determined until apply, so Terraform cannot predict how many instances will be created. To work around this, use the -target argument to first apply only the resources that the for_each depends on.`,
+			Subject:  subject,
+		})
+		return diags
+	}
+
+	if v.AllowNullElements {
+		return diags
+	}
+
+	for it := val.ElementIterator(); it.Next(); {
+		_, elem := it.Element()
+		if elem.IsNull() {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid for_each set argument",
+				Detail:   `The given "for_each" argument value is unsuitable: "for_each" sets must not contain null values.`,
+				Subject:  subject,
+			})
+			return diags
+		}
+	}
+
+	return diags
+}
+
+// validateOrdered handles the list and tuple cases permitted when Ordered
+// is set. The index-derived keys used by forEachMapFromValue are unique
+// by construction, so the only way a list or tuple can be rejected here
+// is if its length can't yet be determined.
+func (v ForEachValidator) validateOrdered(val cty.Value, subject *hcl.Range) tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
+
+	if !val.Type().IsTupleType() {
+		return diags
+	}
+
+	for _, et := range val.Type().TupleElementTypes() {
+		if et != cty.DynamicPseudoType {
+			continue
+		}
+		if v.AllowUnknownLength {
+			return diags
+		}
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid for_each argument",
+			Detail:   `The given "for_each" argument value is unsuitable: its length cannot be determined until apply, so Terraform cannot predict how many instances will be created. To work around this, use the -target argument to first apply only the resources that the for_each depends on.`,
+			Subject:  subject,
+		})
+		return diags
+	}
+
+	return diags
+}
+
+// forEachMapFromValue converts an already-validated for_each value into
+// the map[string]cty.Value representation used throughout the rest of
+// the evaluator, along with an order slice that's non-nil only for the
+// ordered list/tuple case.
+func forEachMapFromValue(val cty.Value, ordered bool) (map[string]cty.Value, []string) {
+	forEach := make(map[string]cty.Value)
+	ty := val.Type()
+
+	switch {
+	case ty.IsMapType(), ty.IsObjectType():
+		for it := val.ElementIterator(); it.Next(); {
+			keyVal, attrVal := it.Element()
+			forEach[keyVal.AsString()] = attrVal
+		}
+		return forEach, nil
+	case ty.IsSetType():
+		for it := val.ElementIterator(); it.Next(); {
+			_, elem := it.Element()
+			forEach[elem.AsString()] = elem
+		}
+		return forEach, nil
+	case ordered && (ty.IsListType() || ty.IsTupleType()):
+		var order []string
+		idx := 0
+		for it := val.ElementIterator(); it.Next(); {
+			_, elem := it.Element()
+			key := strconv.Itoa(idx)
+			forEach[key] = elem
+			order = append(order, key)
+			idx++
+		}
+		return forEach, order
+	default:
+		return forEach, nil
+	}
+}
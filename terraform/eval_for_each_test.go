@@ -52,13 +52,51 @@ func TestEvaluateResourceForEachExpression_valid(t *testing.T) {
 				"b": cty.UnknownVal(cty.Bool),
 			},
 		},
+		"empty object": {
+			hcltest.MockExprLiteral(cty.EmptyObjectVal),
+			map[string]cty.Value{},
+		},
+		"object with heterogeneous attribute types": {
+			hcltest.MockExprLiteral(cty.ObjectVal(map[string]cty.Value{
+				"a": cty.ObjectVal(map[string]cty.Value{
+					"size": cty.NumberIntVal(1),
+				}),
+				"b": cty.ObjectVal(map[string]cty.Value{
+					"size": cty.NumberIntVal(2),
+					"name": cty.StringVal("b"),
+				}),
+			})),
+			map[string]cty.Value{
+				"a": cty.ObjectVal(map[string]cty.Value{
+					"size": cty.NumberIntVal(1),
+				}),
+				"b": cty.ObjectVal(map[string]cty.Value{
+					"size": cty.NumberIntVal(2),
+					"name": cty.StringVal("b"),
+				}),
+			},
+		},
+		"object containing unknown values": {
+			hcltest.MockExprLiteral(cty.ObjectVal(map[string]cty.Value{
+				"a": cty.UnknownVal(cty.String),
+				"b": cty.ObjectVal(map[string]cty.Value{
+					"size": cty.UnknownVal(cty.Number),
+				}),
+			})),
+			map[string]cty.Value{
+				"a": cty.UnknownVal(cty.String),
+				"b": cty.ObjectVal(map[string]cty.Value{
+					"size": cty.UnknownVal(cty.Number),
+				}),
+			},
+		},
 	}
 
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
 			ctx := &MockEvalContext{}
 			ctx.installSimpleEval()
-			forEachMap, diags := evaluateResourceForEachExpression(test.Expr, ctx)
+			forEachMap, _, diags := evaluateResourceForEachExpression(test.Expr, ctx, false)
 
 			if len(diags) != 0 {
 				t.Errorf("unexpected diagnostics %s", spew.Sdump(diags))
@@ -75,6 +113,187 @@ func TestEvaluateResourceForEachExpression_valid(t *testing.T) {
 	}
 }
 
+func TestForEachValidator_Validate(t *testing.T) {
+	tests := map[string]struct {
+		Validator ForEachValidator
+		Value     cty.Value
+		WantValid bool
+	}{
+		"strict rejects list": {
+			ForEachValidator{},
+			cty.ListVal([]cty.Value{cty.StringVal("a")}),
+			false,
+		},
+		"ordered accepts list": {
+			ForEachValidator{Ordered: true},
+			cty.ListVal([]cty.Value{cty.StringVal("a")}),
+			true,
+		},
+		"ordered still rejects unknown-length tuple": {
+			ForEachValidator{Ordered: true},
+			cty.TupleVal([]cty.Value{cty.DynamicVal}),
+			false,
+		},
+		"ordered with AllowUnknownLength accepts unknown-length tuple": {
+			ForEachValidator{Ordered: true, AllowUnknownLength: true},
+			cty.TupleVal([]cty.Value{cty.DynamicVal}),
+			true,
+		},
+		"strict rejects unknown map": {
+			ForEachValidator{},
+			cty.UnknownVal(cty.Map(cty.String)),
+			false,
+		},
+		"AllowUnknownLength accepts unknown map": {
+			ForEachValidator{AllowUnknownLength: true},
+			cty.UnknownVal(cty.Map(cty.String)),
+			true,
+		},
+		"strict rejects cty.DynamicVal": {
+			ForEachValidator{},
+			cty.DynamicVal,
+			false,
+		},
+		"AllowEmptyDynamicPseudoType accepts cty.DynamicVal": {
+			ForEachValidator{AllowEmptyDynamicPseudoType: true},
+			cty.DynamicVal,
+			true,
+		},
+		"strict rejects null set element": {
+			ForEachValidator{},
+			cty.SetVal([]cty.Value{cty.NullVal(cty.String)}),
+			false,
+		},
+		"AllowNullElements accepts null set element": {
+			ForEachValidator{AllowNullElements: true},
+			cty.SetVal([]cty.Value{cty.NullVal(cty.String)}),
+			true,
+		},
+		"strict accepts null map value unaffected by AllowNullElements": {
+			ForEachValidator{},
+			cty.MapVal(map[string]cty.Value{"a": cty.NullVal(cty.String)}),
+			true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			diags := test.Validator.Validate(test.Value)
+			gotValid := !diags.HasErrors()
+			if gotValid != test.WantValid {
+				t.Errorf("got valid=%v, want valid=%v (diags: %s)", gotValid, test.WantValid, spew.Sdump(diags))
+			}
+		})
+	}
+}
+
+func TestForEachValidator_ValidateExpr(t *testing.T) {
+	ctx := &MockEvalContext{}
+	ctx.installSimpleEval()
+
+	expr := hcltest.MockExprLiteral(cty.ListVal([]cty.Value{cty.StringVal("a")}))
+
+	diags := (ForEachValidator{}).ValidateExpr(expr, ctx)
+	if !diags.HasErrors() {
+		t.Errorf("expected an error for a list without Ordered set")
+	}
+
+	diags = (ForEachValidator{Ordered: true}).ValidateExpr(expr, ctx)
+	if diags.HasErrors() {
+		t.Errorf("unexpected diagnostics %s", spew.Sdump(diags))
+	}
+}
+
+func TestEvaluateResourceForEachExpression_ordered(t *testing.T) {
+	tests := map[string]struct {
+		Expr       hcl.Expression
+		ForEachMap map[string]cty.Value
+		Order      []string
+	}{
+		"empty list": {
+			hcltest.MockExprLiteral(cty.ListValEmpty(cty.String)),
+			map[string]cty.Value{},
+			nil,
+		},
+		"list of strings": {
+			hcltest.MockExprLiteral(cty.ListVal([]cty.Value{cty.StringVal("b"), cty.StringVal("a")})),
+			map[string]cty.Value{
+				"0": cty.StringVal("b"),
+				"1": cty.StringVal("a"),
+			},
+			[]string{"0", "1"},
+		},
+		"tuple of heterogeneous types": {
+			hcltest.MockExprLiteral(cty.TupleVal([]cty.Value{cty.StringVal("a"), cty.NumberIntVal(2)})),
+			map[string]cty.Value{
+				"0": cty.StringVal("a"),
+				"1": cty.NumberIntVal(2),
+			},
+			[]string{"0", "1"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := &MockEvalContext{}
+			ctx.installSimpleEval()
+			forEachMap, order, diags := evaluateResourceForEachExpression(test.Expr, ctx, true)
+
+			if len(diags) != 0 {
+				t.Errorf("unexpected diagnostics %s", spew.Sdump(diags))
+			}
+
+			if !reflect.DeepEqual(forEachMap, test.ForEachMap) {
+				t.Errorf(
+					"wrong map value\ngot:  %swant: %s",
+					spew.Sdump(forEachMap), spew.Sdump(test.ForEachMap),
+				)
+			}
+
+			if !reflect.DeepEqual(order, test.Order) {
+				t.Errorf("wrong order\ngot:  %#v\nwant: %#v", order, test.Order)
+			}
+		})
+	}
+}
+
+func TestEvaluateResourceForEachExpression_orderedErrors(t *testing.T) {
+	tests := map[string]struct {
+		Expr                     hcl.Expression
+		Summary, DetailSubstring string
+	}{
+		"list without for_each_ordered": {
+			hcltest.MockExprLiteral(cty.ListVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b")})),
+			"Invalid for_each argument",
+			"To use a list or tuple, set for_each_ordered = true",
+		},
+		"tuple with an unknown-typed element": {
+			hcltest.MockExprLiteral(cty.TupleVal([]cty.Value{cty.StringVal("a"), cty.DynamicVal})),
+			"Invalid for_each argument",
+			"its length cannot be determined until apply",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := &MockEvalContext{}
+			ctx.installSimpleEval()
+			ordered := name != "list without for_each_ordered"
+			_, _, diags := evaluateResourceForEachExpression(test.Expr, ctx, ordered)
+
+			if len(diags) != 1 {
+				t.Fatalf("got %d diagnostics; want 1", diags)
+			}
+			if got, want := diags[0].Description().Summary, test.Summary; got != want {
+				t.Errorf("wrong diagnostic summary %#v; want %#v", got, want)
+			}
+			if got, want := diags[0].Description().Detail, test.DetailSubstring; !strings.Contains(got, want) {
+				t.Errorf("wrong diagnostic detail %#v; want %#v", got, want)
+			}
+		})
+	}
+}
+
 func TestEvaluateResourceForEachExpression_errors(t *testing.T) {
 	tests := map[string]struct {
 		Expr                     hcl.Expression
@@ -125,13 +344,20 @@ func TestEvaluateResourceForEachExpression_errors(t *testing.T) {
 			"Invalid for_each argument",
 			"depends on resource attributes that cannot be determined until apply",
 		},
+		"object with an empty attribute name": {
+			hcltest.MockExprLiteral(cty.ObjectVal(map[string]cty.Value{
+				"": cty.StringVal("a"),
+			})),
+			"Invalid for_each argument",
+			"an empty string is not a valid instance key",
+		},
 	}
 
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
 			ctx := &MockEvalContext{}
 			ctx.installSimpleEval()
-			_, diags := evaluateResourceForEachExpression(test.Expr, ctx)
+			_, _, diags := evaluateResourceForEachExpression(test.Expr, ctx, false)
 
 			if len(diags) != 1 {
 				t.Fatalf("got %d diagnostics; want 1", diags)
@@ -159,7 +385,7 @@ func TestEvaluateResourceForEachExpressionKnown(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			ctx := &MockEvalContext{}
 			ctx.installSimpleEval()
-			forEachMap, known, diags := evaluateResourceForEachExpressionKnown(expr, ctx)
+			forEachMap, _, known, diags := evaluateResourceForEachExpressionKnown(expr, ctx, false)
 
 			if len(diags) != 0 {
 				t.Errorf("unexpected diagnostics %s", spew.Sdump(diags))